@@ -0,0 +1,120 @@
+package headscale
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefixBytes = 6
+	apiKeySecretBytes = 24
+)
+
+// APIKey is a bearer token accepted by the gRPC and grpc-gateway API
+// surfaces. Only a SHA-256 hash of the secret half is ever persisted; the
+// raw key is shown to the operator once, at creation time, by `hs apikey
+// create`.
+type APIKey struct {
+	Prefix    string `gorm:"primary_key"`
+	Hash      string
+	ScopesRaw string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// Scopes returns the permission scopes this key was issued with.
+func (k *APIKey) Scopes() []string {
+	if k.ScopesRaw == "" {
+		return nil
+	}
+
+	return strings.Split(k.ScopesRaw, ",")
+}
+
+// Expired reports whether the key is past its ExpiresAt.
+func (k *APIKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt)
+}
+
+// hashAPIKeySecret returns the hex-encoded SHA-256 digest of secret. Keys
+// are high-entropy random tokens rather than user-chosen passwords, so a
+// fast hash is appropriate here, unlike a password hash.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKeySecret returns a random (prefix, secret) pair. prefix is
+// stored in the clear as the lookup key; secret is never stored, only its
+// hash.
+func generateAPIKeySecret() (prefix string, secret string, err error) {
+	prefixBytes := make([]byte, apiKeyPrefixBytes)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", "", fmt.Errorf("generating API key prefix: %w", err)
+	}
+
+	secretBytes := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", fmt.Errorf("generating API key secret: %w", err)
+	}
+
+	return hex.EncodeToString(prefixBytes), hex.EncodeToString(secretBytes), nil
+}
+
+// CreateAPIKey issues a new API key with the given lifetime and scopes,
+// persists its hash via store, and returns the raw "prefix.secret" token.
+// This is what `hs apikey create` calls into.
+func CreateAPIKey(store Datastore, expiry time.Duration, scopes []string) (string, error) {
+	prefix, secret, err := generateAPIKeySecret()
+	if err != nil {
+		return "", err
+	}
+
+	key := &APIKey{
+		Prefix:    prefix,
+		Hash:      hashAPIKeySecret(secret),
+		ScopesRaw: strings.Join(scopes, ","),
+		CreatedAt: time.Now().UTC(),
+	}
+	if expiry > 0 {
+		key.ExpiresAt = time.Now().UTC().Add(expiry)
+	}
+
+	if err := store.CreateAPIKey(key); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s.%s", prefix, secret), nil
+}
+
+// ValidateAPIKey looks up raw (a "prefix.secret" token) and returns the
+// matching APIKey if it exists, is unexpired, and the secret's hash
+// matches what was stored.
+func ValidateAPIKey(store Datastore, raw string) (*APIKey, error) {
+	prefix, secret, found := strings.Cut(raw, ".")
+	if !found {
+		return nil, errors.New("malformed API key")
+	}
+
+	key, err := store.GetAPIKeyByPrefix(prefix)
+	if err != nil {
+		return nil, errors.New("unknown API key")
+	}
+
+	if key.Expired() {
+		return nil, errors.New("API key has expired")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, errors.New("invalid API key")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,43 @@
+package headscale
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateAPIKey(t *testing.T) {
+	store := newMemoryDatastore()
+
+	validKey, err := CreateAPIKey(store, time.Hour, []string{"admin"})
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	prefix, _, _ := strings.Cut(validKey, ".")
+
+	expiredKey, err := CreateAPIKey(store, time.Nanosecond, nil)
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{"happy path", validKey, false},
+		{"malformed", "not-a-key", true},
+		{"unknown prefix", "deadbeef.deadbeef", true},
+		{"expired", expiredKey, true},
+		{"wrong secret", prefix + ".wrongsecret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ValidateAPIKey(store, tt.raw); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateAPIKey(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+		})
+	}
+}
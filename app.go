@@ -24,10 +24,9 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/soheilhy/cmux"
 	ginprometheus "github.com/zsais/go-gin-prometheus"
-	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"gorm.io/gorm"
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
@@ -62,6 +61,10 @@ type Config struct {
 	TLSCertPath string
 	TLSKeyPath  string
 
+	TLS TLSConfig
+
+	GRPC GRPCConfig
+
 	ACMEURL   string
 	ACMEEmail string
 
@@ -78,6 +81,31 @@ type OIDCConfig struct {
 	ClientID     string
 	ClientSecret string
 	MatchMap     map[string]string
+
+	// AllowedGroups restricts sign-in to members of at least one of these
+	// groups, as reported in the OIDC "groups" claim. Empty means every
+	// authenticated user is allowed.
+	AllowedGroups []string
+
+	// NamespaceClaim names the claim used to derive the namespace a user
+	// is provisioned into, e.g. "email" or "groups". Defaults to "email"
+	// when unset.
+	NamespaceClaim string
+
+	// StripEmailDomain removes the "@domain" part of the email claim
+	// before using it as a namespace name, so "alice@example.com" becomes
+	// namespace "alice".
+	StripEmailDomain bool
+}
+
+// GRPCConfig configures authentication for the gRPC and grpc-gateway API
+// surfaces.
+type GRPCConfig struct {
+	// AdminMTLSSANs lists the client certificate SANs (DNS names or URIs,
+	// e.g. a SPIFFE ID) that are accepted as authenticated admins over
+	// mTLS, in addition to bearer API tokens issued via `hs apikey
+	// create`.
+	AdminMTLSSANs []string
 }
 
 type DERPConfig struct {
@@ -91,6 +119,7 @@ type DERPConfig struct {
 type Headscale struct {
 	cfg        Config
 	db         *gorm.DB
+	store      Datastore
 	dbString   string
 	dbType     string
 	dbDebug    bool
@@ -104,6 +133,11 @@ type Headscale struct {
 
 	lastStateChange sync.Map
 
+	eventSubsMu sync.Mutex
+	eventSubs   map[string][]chan Event
+
+	certProvider CertProvider
+
 	oidcProvider   *oidc.Provider
 	oauth2Config   *oauth2.Config
 	oidcStateCache *cache.Cache
@@ -140,6 +174,7 @@ func NewHeadscale(cfg Config) (*Headscale, error) {
 		privateKey: privKey,
 		publicKey:  &pubKey,
 		aclRules:   &tailcfg.FilterAllowAll, // default allowall
+		eventSubs:  make(map[string][]chan Event),
 	}
 
 	err = h.initDB()
@@ -147,6 +182,14 @@ func NewHeadscale(cfg Config) (*Headscale, error) {
 		return nil, err
 	}
 
+	// The GORM-backed Datastore is the default; tests that don't need a
+	// real database can construct a Headscale with h.store swapped for
+	// newMemoryDatastore() instead of going through NewHeadscale.
+	h.store, err = newGormDatastore(h.db)
+	if err != nil {
+		return nil, err
+	}
+
 	if cfg.OIDC.Issuer != "" {
 		err = h.initOIDC()
 		if err != nil {
@@ -178,16 +221,26 @@ func (h *Headscale) redirect(w http.ResponseWriter, req *http.Request) {
 }
 
 // expireEphemeralNodes deletes ephemeral machine records that have not been
-// seen for longer than h.cfg.EphemeralNodeInactivityTimeout.
-func (h *Headscale) expireEphemeralNodes(milliSeconds int64) {
+// seen for longer than h.cfg.EphemeralNodeInactivityTimeout. It still runs on
+// a ticker, since there is nothing to wait on until a node actually goes
+// stale, but it stops promptly when ctx is cancelled instead of leaking the
+// goroutine for the lifetime of the process.
+func (h *Headscale) expireEphemeralNodes(ctx context.Context, milliSeconds int64) {
 	ticker := time.NewTicker(time.Duration(milliSeconds) * time.Millisecond)
-	for range ticker.C {
-		h.expireEphemeralNodesWorker()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.expireEphemeralNodesWorker()
+		}
 	}
 }
 
 func (h *Headscale) expireEphemeralNodesWorker() {
-	namespaces, err := h.ListNamespaces()
+	namespaces, err := h.store.ListNamespaces()
 	if err != nil {
 		log.Error().Err(err).Msg("Error listing namespaces")
 
@@ -195,7 +248,7 @@ func (h *Headscale) expireEphemeralNodesWorker() {
 	}
 
 	for _, ns := range *namespaces {
-		machines, err := h.ListMachinesInNamespace(ns.Name)
+		machines, err := h.store.ListMachinesInNamespace(ns.Name)
 		if err != nil {
 			log.Error().Err(err).Str("namespace", ns.Name).Msg("Error listing machines in namespace")
 
@@ -207,7 +260,7 @@ func (h *Headscale) expireEphemeralNodesWorker() {
 				time.Now().After(m.LastSeen.Add(h.cfg.EphemeralNodeInactivityTimeout)) {
 				log.Info().Str("machine", m.Name).Msg("Ephemeral client removed from database")
 
-				err = h.db.Unscoped().Delete(m).Error
+				err = h.store.DeleteMachine(&m)
 				if err != nil {
 					log.Error().
 						Err(err).
@@ -223,10 +276,17 @@ func (h *Headscale) expireEphemeralNodesWorker() {
 
 // WatchForKVUpdates checks the KV DB table for requests to perform tailnet upgrades
 // This is a way to communitate the CLI with the headscale server.
-func (h *Headscale) watchForKVUpdates(milliSeconds int64) {
+func (h *Headscale) watchForKVUpdates(ctx context.Context, milliSeconds int64) {
 	ticker := time.NewTicker(time.Duration(milliSeconds) * time.Millisecond)
-	for range ticker.C {
-		h.watchForKVUpdatesWorker()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.watchForKVUpdatesWorker()
+		}
 	}
 }
 
@@ -249,6 +309,36 @@ func (h *Headscale) Serve() error {
 		panic(err)
 	}
 
+	tlsConfig, err := h.getTLSSettings()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set up TLS configuration")
+
+		return err
+	}
+
+	if h.certProvider != nil {
+		defer h.certProvider.Close()
+	}
+
+	// Terminate TLS ahead of cmux, rather than inside the grpc server or
+	// httpServer individually: cmux's protocol matcher sniffs cleartext
+	// HTTP/2 bytes to route a connection to grpcListener, which only works
+	// on already-decrypted traffic, and grpc-gateway's in-process client
+	// below has to dial with credentials matching whatever the listener
+	// actually speaks.
+	var grpcCreds credentials.TransportCredentials
+
+	if tlsConfig != nil {
+		edgeTLSConfig := tlsConfig.Clone()
+		// Request, but don't require, a client certificate: bearer-token
+		// callers don't present one, and authenticateGRPCMTLS only needs to
+		// see PeerCertificates when one is given.
+		edgeTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+		l = tls.NewListener(l, edgeTLSConfig)
+		grpcCreds = newGRPCPassthroughCreds()
+	}
+
 	// Create the cmux object that will multiplex 2 protocols on the same port.
 	// The two following listeners will be served on the same port below gracefully.
 	m := cmux.New(l)
@@ -257,17 +347,48 @@ func (h *Headscale) Serve() error {
 	// Otherwise match regular http requests.
 	httpListener := m.Match(cmux.Any())
 
-	// Now create the grpc server with those options.
-	grpcServer := grpc.NewServer()
+	grpcServerOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(h.grpcUnaryAuthInterceptor),
+		grpc.ChainStreamInterceptor(h.grpcStreamAuthInterceptor),
+	}
+
+	if grpcCreds != nil {
+		grpcServerOpts = append(grpcServerOpts, grpc.Creds(grpcCreds))
+	}
 
-	// TODO(kradalby): register the new server when we have authentication ready
-	// apiV1.RegisterHeadscaleServiceServer(grpcServer, newHeadscaleV1APIServer(h))
+	// Now create the grpc server with those options, authenticating every
+	// call via a bearer API token or an admin mTLS client certificate.
+	grpcServer := grpc.NewServer(grpcServerOpts...)
 
-	grpcGatewayMux := runtime.NewServeMux()
+	apiV1.RegisterHeadscaleServiceServer(grpcServer, newHeadscaleV1APIServer(h))
 
-	opts := []grpc.DialOption{grpc.WithInsecure()}
+	// Forward the raw Authorization header through to the gRPC metadata the
+	// interceptors above inspect; by default grpc-gateway only forwards
+	// headers prefixed Grpc-Metadata-.
+	grpcGatewayMux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(func(key string) (string, bool) {
+			if strings.EqualFold(key, "authorization") {
+				return "authorization", true
+			}
 
-	err = apiV1.RegisterHeadscaleServiceHandlerFromEndpoint(ctx, grpcGatewayMux, h.cfg.Addr, opts)
+			return runtime.DefaultHeaderMatcher(key)
+		}),
+	)
+
+	// The gateway dials back into this same listener, so it needs transport
+	// credentials matching whatever edgeTLSConfig above put on the wire:
+	// plaintext when there's no TLS, TLS when there is. It skips verifying
+	// the server certificate altogether (InsecureSkipVerify), chain and name
+	// alike, since this is always a loopback dial to an address headscale's
+	// own certificate was never asked to cover.
+	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+	if tlsConfig != nil {
+		dialOpts = []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})),
+		}
+	}
+
+	err = apiV1.RegisterHeadscaleServiceHandlerFromEndpoint(ctx, grpcGatewayMux, h.cfg.Addr, dialOpts)
 	if err != nil {
 		return err
 	}
@@ -302,8 +423,8 @@ func (h *Headscale) Serve() error {
 	}
 
 	// I HATE THIS
-	go h.watchForKVUpdates(updateMillisecondsWait)
-	go h.expireEphemeralNodes(updateMillisecondsWait)
+	go h.watchForKVUpdates(ctx, updateMillisecondsWait)
+	go h.expireEphemeralNodes(ctx, updateMillisecondsWait)
 
 	httpServer := &http.Server{
 		Addr:        h.cfg.Addr,
@@ -316,16 +437,9 @@ func (h *Headscale) Serve() error {
 		WriteTimeout: 0,
 	}
 
-	tlsConfig, err := h.getTLSSettings()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to set up TLS configuration")
-
-		return err
-	}
-
-	if tlsConfig != nil {
-		httpServer.TLSConfig = tlsConfig
-	}
+	// httpServer does not need its own TLSConfig: when tlsConfig != nil, l
+	// (and therefore httpListener) already carries decrypted traffic off the
+	// shared TLS-terminating listener constructed above.
 
 	g := new(errgroup.Group)
 
@@ -338,66 +452,11 @@ func (h *Headscale) Serve() error {
 	return g.Wait()
 }
 
-func (h *Headscale) getTLSSettings() (*tls.Config, error) {
-	if h.cfg.TLSLetsEncryptHostname != "" {
-		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
-			log.Warn().Msg("Listening with TLS but ServerURL does not start with https://")
-		}
-
-		m := autocert.Manager{
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(h.cfg.TLSLetsEncryptHostname),
-			Cache:      autocert.DirCache(h.cfg.TLSLetsEncryptCacheDir),
-			Client: &acme.Client{
-				DirectoryURL: h.cfg.ACMEURL,
-			},
-			Email: h.cfg.ACMEEmail,
-		}
-
-		if h.cfg.TLSLetsEncryptChallengeType == "TLS-ALPN-01" {
-			// Configuration via autocert with TLS-ALPN-01 (https://tools.ietf.org/html/rfc8737)
-			// The RFC requires that the validation is done on port 443; in other words, headscale
-			// must be reachable on port 443.
-			return m.TLSConfig(), nil
-		} else if h.cfg.TLSLetsEncryptChallengeType == "HTTP-01" {
-			// Configuration via autocert with HTTP-01. This requires listening on
-			// port 80 for the certificate validation in addition to the headscale
-			// service, which can be configured to run on any other port.
-			go func() {
-				log.Fatal().
-					Err(http.ListenAndServe(h.cfg.TLSLetsEncryptListen, m.HTTPHandler(http.HandlerFunc(h.redirect)))).
-					Msg("failed to set up a HTTP server")
-			}()
-
-			return m.TLSConfig(), nil
-		} else {
-			return nil, errors.New("unknown value for TLSLetsEncryptChallengeType")
-		}
-	} else if h.cfg.TLSCertPath == "" {
-		if !strings.HasPrefix(h.cfg.ServerURL, "http://") {
-			log.Warn().Msg("Listening without TLS but ServerURL does not start with http://")
-		}
-
-		return nil, nil
-	} else {
-		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
-			log.Warn().Msg("Listening with TLS but ServerURL does not start with https://")
-		}
-		var err error
-		tlsConfig := &tls.Config{}
-		tlsConfig.ClientAuth = tls.RequireAnyClientCert
-		tlsConfig.NextProtos = []string{"http/1.1"}
-		tlsConfig.Certificates = make([]tls.Certificate, 1)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(h.cfg.TLSCertPath, h.cfg.TLSKeyPath)
-
-		return tlsConfig, err
-	}
-}
-
 func (h *Headscale) setLastStateChangeToNow(namespace string) {
 	now := time.Now().UTC()
 	lastStateUpdate.WithLabelValues("", "headscale").Set(float64(now.Unix()))
 	h.lastStateChange.Store(namespace, now)
+	h.publishEvent(Event{Type: EventStateChange, Namespace: namespace, Timestamp: now})
 }
 
 func (h *Headscale) getLastStateChange(namespaces ...string) time.Time {
@@ -0,0 +1,355 @@
+package headscale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Datastore covers the persistence operations Headscale needs: namespace
+// and machine CRUD, the polling KV table, and ACL policy storage. The
+// production implementation (gormDatastore) backs onto the configured SQL
+// database; memoryDatastore backs the same interface with plain Go maps so
+// unit tests don't have to pay for a real sqlite file per test.
+type Datastore interface {
+	ListNamespaces() (*[]Namespace, error)
+	GetNamespace(name string) (*Namespace, error)
+	CreateNamespace(name string) (*Namespace, error)
+
+	ListMachinesInNamespace(namespace string) (*[]Machine, error)
+	CreateMachine(machine *Machine) error
+	GetMachineByID(id uint64) (*Machine, error)
+	UpdateMachine(machine *Machine) error
+	DeleteMachine(machine *Machine) error
+
+	GetValue(key string) (string, error)
+	SetValue(key, value string) error
+
+	GetACLPolicy() (*ACLPolicy, error)
+	SetACLPolicy(policy *ACLPolicy) error
+
+	CreateAPIKey(key *APIKey) error
+	GetAPIKeyByPrefix(prefix string) (*APIKey, error)
+}
+
+// KVStore is the generic key/value table used to communicate out-of-band
+// requests (tailnet upgrades, the ACL policy blob) between the CLI and a
+// running headscale server.
+type KVStore struct {
+	Key   string `gorm:"primary_key"`
+	Value string
+}
+
+// gormDatastore is the Datastore implementation backed by GORM, i.e. the
+// behaviour headscale has always had against postgres/sqlite3.
+type gormDatastore struct {
+	db *gorm.DB
+}
+
+// newGormDatastore wraps db as a Datastore. It also defensively migrates the
+// APIKey table itself: APIKey is new enough that an out-of-tree initDB()
+// migration list may not yet include it, and CreateAPIKey/GetAPIKeyByPrefix
+// would otherwise fail at runtime against a database that predates it.
+func newGormDatastore(db *gorm.DB) (Datastore, error) {
+	if err := db.AutoMigrate(&APIKey{}); err != nil {
+		return nil, fmt.Errorf("migrating APIKey table: %w", err)
+	}
+
+	return &gormDatastore{db: db}, nil
+}
+
+func (s *gormDatastore) ListNamespaces() (*[]Namespace, error) {
+	namespaces := []Namespace{}
+	if err := s.db.Find(&namespaces).Error; err != nil {
+		return nil, err
+	}
+
+	return &namespaces, nil
+}
+
+func (s *gormDatastore) GetNamespace(name string) (*Namespace, error) {
+	var namespace Namespace
+	if err := s.db.First(&namespace, "name = ?", name).Error; err != nil {
+		return nil, err
+	}
+
+	return &namespace, nil
+}
+
+func (s *gormDatastore) CreateNamespace(name string) (*Namespace, error) {
+	namespace := Namespace{Name: name}
+	if err := s.db.Create(&namespace).Error; err != nil {
+		return nil, err
+	}
+
+	return &namespace, nil
+}
+
+func (s *gormDatastore) ListMachinesInNamespace(namespace string) (*[]Machine, error) {
+	machines := []Machine{}
+	if err := s.db.Preload("AuthKey").Where("namespace = ?", namespace).Find(&machines).Error; err != nil {
+		return nil, err
+	}
+
+	return &machines, nil
+}
+
+func (s *gormDatastore) CreateMachine(machine *Machine) error {
+	return s.db.Create(machine).Error
+}
+
+func (s *gormDatastore) GetMachineByID(id uint64) (*Machine, error) {
+	var machine Machine
+	if err := s.db.Preload("AuthKey").Preload("Namespace").First(&machine, id).Error; err != nil {
+		return nil, err
+	}
+
+	return &machine, nil
+}
+
+func (s *gormDatastore) UpdateMachine(machine *Machine) error {
+	return s.db.Save(machine).Error
+}
+
+func (s *gormDatastore) DeleteMachine(machine *Machine) error {
+	return s.db.Unscoped().Delete(machine).Error
+}
+
+func (s *gormDatastore) GetValue(key string) (string, error) {
+	var kv KVStore
+	if err := s.db.First(&kv, "key = ?", key).Error; err != nil {
+		return "", err
+	}
+
+	return kv.Value, nil
+}
+
+func (s *gormDatastore) SetValue(key, value string) error {
+	kv := KVStore{Key: key, Value: value}
+
+	return s.db.Save(&kv).Error
+}
+
+func (s *gormDatastore) GetACLPolicy() (*ACLPolicy, error) {
+	raw, err := s.GetValue("acl_policy")
+	if err != nil {
+		return nil, err
+	}
+
+	var policy ACLPolicy
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+func (s *gormDatastore) SetACLPolicy(policy *ACLPolicy) error {
+	raw, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return s.SetValue("acl_policy", string(raw))
+}
+
+func (s *gormDatastore) CreateAPIKey(key *APIKey) error {
+	return s.db.Create(key).Error
+}
+
+func (s *gormDatastore) GetAPIKeyByPrefix(prefix string) (*APIKey, error) {
+	var key APIKey
+	if err := s.db.First(&key, "prefix = ?", prefix).Error; err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// memoryDatastore is an in-memory Datastore for tests that don't care about
+// durability, so they can skip sqlite setup entirely.
+type memoryDatastore struct {
+	mu sync.Mutex
+
+	namespaces    map[string]Namespace
+	machines      map[uint64]Machine
+	nextMachineID uint64
+	kv            map[string]string
+	policy        *ACLPolicy
+	apiKeys       map[string]APIKey
+}
+
+// newMemoryDatastore returns an empty, ready-to-use in-memory Datastore.
+func newMemoryDatastore() Datastore {
+	return &memoryDatastore{
+		namespaces: make(map[string]Namespace),
+		machines:   make(map[uint64]Machine),
+		kv:         make(map[string]string),
+		apiKeys:    make(map[string]APIKey),
+	}
+}
+
+func (s *memoryDatastore) ListNamespaces() (*[]Namespace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespaces := make([]Namespace, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+
+	return &namespaces, nil
+}
+
+func (s *memoryDatastore) GetNamespace(name string) (*Namespace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespace, ok := s.namespaces[name]
+	if !ok {
+		return nil, errors.New("namespace not found")
+	}
+
+	return &namespace, nil
+}
+
+func (s *memoryDatastore) CreateNamespace(name string) (*Namespace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.namespaces[name]; ok {
+		return nil, errors.New("namespace already exists")
+	}
+
+	namespace := Namespace{Name: name}
+	s.namespaces[name] = namespace
+
+	return &namespace, nil
+}
+
+func (s *memoryDatastore) ListMachinesInNamespace(namespace string) (*[]Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machines := []Machine{}
+	for _, m := range s.machines {
+		if m.Namespace.Name == namespace {
+			machines = append(machines, m)
+		}
+	}
+
+	return &machines, nil
+}
+
+func (s *memoryDatastore) CreateMachine(machine *Machine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if machine.ID == 0 {
+		s.nextMachineID++
+		machine.ID = s.nextMachineID
+	}
+
+	s.machines[machine.ID] = *machine
+
+	return nil
+}
+
+func (s *memoryDatastore) GetMachineByID(id uint64) (*Machine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machine, ok := s.machines[id]
+	if !ok {
+		return nil, errors.New("machine not found")
+	}
+
+	return &machine, nil
+}
+
+func (s *memoryDatastore) UpdateMachine(machine *Machine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.machines[machine.ID]; !ok {
+		return errors.New("machine not found")
+	}
+
+	s.machines[machine.ID] = *machine
+
+	return nil
+}
+
+func (s *memoryDatastore) DeleteMachine(machine *Machine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.machines, machine.ID)
+
+	return nil
+}
+
+func (s *memoryDatastore) GetValue(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.kv[key]
+	if !ok {
+		return "", errors.New("key not found")
+	}
+
+	return value, nil
+}
+
+func (s *memoryDatastore) SetValue(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.kv[key] = value
+
+	return nil
+}
+
+func (s *memoryDatastore) GetACLPolicy() (*ACLPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.policy == nil {
+		return nil, errors.New("no ACL policy set")
+	}
+
+	return s.policy, nil
+}
+
+func (s *memoryDatastore) SetACLPolicy(policy *ACLPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy = policy
+
+	return nil
+}
+
+func (s *memoryDatastore) CreateAPIKey(key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiKeys[key.Prefix] = *key
+
+	return nil
+}
+
+func (s *memoryDatastore) GetAPIKeyByPrefix(prefix string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[prefix]
+	if !ok {
+		return nil, errors.New("API key not found")
+	}
+
+	return &key, nil
+}
@@ -0,0 +1,69 @@
+package headscale
+
+import "testing"
+
+func TestMemoryDatastoreMachineCRUD(t *testing.T) {
+	store := newMemoryDatastore()
+
+	namespace, err := store.CreateNamespace("test")
+	if err != nil {
+		t.Fatalf("CreateNamespace() error = %v", err)
+	}
+
+	machine := &Machine{Name: "machine1", Namespace: *namespace}
+	if err := store.CreateMachine(machine); err != nil {
+		t.Fatalf("CreateMachine() error = %v", err)
+	}
+	if machine.ID == 0 {
+		t.Fatal("CreateMachine() did not assign an ID")
+	}
+
+	got, err := store.GetMachineByID(machine.ID)
+	if err != nil {
+		t.Fatalf("GetMachineByID() error = %v", err)
+	}
+	if got.Name != "machine1" {
+		t.Errorf("GetMachineByID() Name = %q, want %q", got.Name, "machine1")
+	}
+
+	got.Name = "renamed"
+	if err := store.UpdateMachine(got); err != nil {
+		t.Fatalf("UpdateMachine() error = %v", err)
+	}
+
+	got, err = store.GetMachineByID(machine.ID)
+	if err != nil {
+		t.Fatalf("GetMachineByID() error = %v", err)
+	}
+	if got.Name != "renamed" {
+		t.Errorf("UpdateMachine() did not persist, Name = %q", got.Name)
+	}
+
+	if err := store.DeleteMachine(got); err != nil {
+		t.Fatalf("DeleteMachine() error = %v", err)
+	}
+
+	if _, err := store.GetMachineByID(machine.ID); err == nil {
+		t.Error("GetMachineByID() expected error after delete")
+	}
+}
+
+func TestMemoryDatastoreNamespaceCreate(t *testing.T) {
+	store := newMemoryDatastore()
+
+	if _, err := store.CreateNamespace("dup"); err != nil {
+		t.Fatalf("CreateNamespace() error = %v", err)
+	}
+
+	if _, err := store.CreateNamespace("dup"); err == nil {
+		t.Error("CreateNamespace() expected error for duplicate name")
+	}
+
+	if _, err := store.GetNamespace("dup"); err != nil {
+		t.Errorf("GetNamespace() error = %v", err)
+	}
+
+	if _, err := store.GetNamespace("missing"); err == nil {
+		t.Error("GetNamespace() expected error for unknown namespace")
+	}
+}
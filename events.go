@@ -0,0 +1,69 @@
+package headscale
+
+import (
+	"time"
+)
+
+// EventType describes the kind of state change an Event carries.
+type EventType int
+
+const (
+	// EventStateChange is emitted whenever a namespace's state changes in a
+	// way that should cause polling clients to refresh their netmap, e.g.
+	// peers changing, ACLs reloading, or ephemeral nodes being reaped.
+	EventStateChange EventType = iota
+)
+
+// Event is a single notification pushed to namespace subscribers.
+type Event struct {
+	Type      EventType
+	Namespace string
+	Timestamp time.Time
+}
+
+// Subscribe registers the caller for Events scoped to namespace and returns
+// the channel to receive them plus a cancel function that must be called to
+// unregister the channel once the caller is done listening. cancel does not
+// close the channel: publishEvent may be sending to it concurrently, and a
+// send on a closed channel panics regardless of the select/default guard
+// around it, so the channel is simply left for the garbage collector once
+// nothing holds a reference to it.
+func (h *Headscale) Subscribe(namespace string) (<-chan Event, func()) {
+	ch := make(chan Event, 8)
+
+	h.eventSubsMu.Lock()
+	h.eventSubs[namespace] = append(h.eventSubs[namespace], ch)
+	h.eventSubsMu.Unlock()
+
+	cancel := func() {
+		h.eventSubsMu.Lock()
+		defer h.eventSubsMu.Unlock()
+
+		subs := h.eventSubs[namespace]
+		for i, sub := range subs {
+			if sub == ch {
+				h.eventSubs[namespace] = append(subs[:i], subs[i+1:]...)
+
+				break
+			}
+		}
+	}
+
+	return ch, cancel
+}
+
+// publishEvent notifies every subscriber of namespace that evt occurred. It
+// never blocks: subscribers that are not keeping up with their channel will
+// miss the event rather than stall the publisher.
+func (h *Headscale) publishEvent(evt Event) {
+	h.eventSubsMu.Lock()
+	subs := append([]chan Event(nil), h.eventSubs[evt.Namespace]...)
+	h.eventSubsMu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- evt:
+		default:
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package headscale
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcUnaryAuthInterceptor rejects unary RPCs that present neither a valid
+// bearer API token nor an mTLS client certificate on the configured admin
+// allowlist.
+func (h *Headscale) grpcUnaryAuthInterceptor(
+	ctx context.Context,
+	req any,
+	_ *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (any, error) {
+	if err := h.authenticateGRPC(ctx); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// grpcStreamAuthInterceptor is the streaming-RPC counterpart of
+// grpcUnaryAuthInterceptor.
+func (h *Headscale) grpcStreamAuthInterceptor(
+	srv any,
+	stream grpc.ServerStream,
+	_ *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := h.authenticateGRPC(stream.Context()); err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
+
+// authenticateGRPC accepts a call if either the bearer API token or the
+// mTLS client certificate checks out.
+func (h *Headscale) authenticateGRPC(ctx context.Context) error {
+	if err := h.authenticateGRPCBearerToken(ctx); err == nil {
+		return nil
+	}
+
+	if err := h.authenticateGRPCMTLS(ctx); err == nil {
+		return nil
+	}
+
+	return status.Error(codes.Unauthenticated, "missing or invalid credentials")
+}
+
+func (h *Headscale) authenticateGRPCBearerToken(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing metadata")
+	}
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return status.Error(codes.Unauthenticated, "missing authorization header")
+	}
+
+	token := strings.TrimPrefix(values[0], "Bearer ")
+	if token == values[0] {
+		return status.Error(codes.Unauthenticated, "authorization header is not a bearer token")
+	}
+
+	if _, err := ValidateAPIKey(h.store, token); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return nil
+}
+
+// authenticateGRPCMTLS accepts the call if the client presented a
+// certificate whose SAN matches one of h.cfg.GRPC.AdminMTLSSANs.
+func (h *Headscale) authenticateGRPCMTLS(ctx context.Context) error {
+	if len(h.cfg.GRPC.AdminMTLSSANs) == 0 {
+		return status.Error(codes.Unauthenticated, "mTLS admin access is not configured")
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "no peer information")
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return status.Error(codes.Unauthenticated, "no client certificate presented")
+	}
+
+	cert := tlsInfo.State.PeerCertificates[0]
+
+	for _, allowed := range h.cfg.GRPC.AdminMTLSSANs {
+		for _, name := range allowedCertNames(cert) {
+			if name == allowed {
+				return nil
+			}
+		}
+	}
+
+	return status.Error(codes.PermissionDenied, "client certificate is not on the admin allowlist")
+}
+
+// allowedCertNames returns every SAN on cert that could be matched against
+// the admin allowlist: DNS names and URIs (the latter covers SPIFFE IDs).
+func allowedCertNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.URIs))
+	names = append(names, cert.DNSNames...)
+
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// grpcPassthroughCreds is a grpc.ServerOption credential that reuses a TLS
+// handshake the cmux-wrapped listener in Serve already completed, instead of
+// performing a second one. cmux's protocol sniffing has to read cleartext
+// HTTP/2 bytes to route a connection to the gRPC listener, which only works
+// if TLS was terminated ahead of cmux; grpc's own credentials.NewTLS expects
+// to drive the handshake itself on an as-yet-unencrypted net.Conn, which is
+// incompatible with that. This type satisfies credentials.TransportCredentials
+// without redoing the handshake, so authenticateGRPCMTLS still sees
+// PeerCertificates via the connection's already-completed tls.ConnectionState.
+type grpcPassthroughCreds struct{}
+
+func newGRPCPassthroughCreds() credentials.TransportCredentials {
+	return grpcPassthroughCreds{}
+}
+
+func (grpcPassthroughCreds) ClientHandshake(
+	context.Context,
+	string,
+	net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("grpcPassthroughCreds is server-only")
+}
+
+func (grpcPassthroughCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	tlsConn, ok := unwrapTLSConn(conn)
+	if !ok {
+		return nil, nil, errors.New("grpcPassthroughCreds: connection was not TLS-terminated ahead of cmux")
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+
+	return tlsConn, credentials.TLSInfo{State: tlsConn.ConnectionState()}, nil
+}
+
+func (grpcPassthroughCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls"}
+}
+
+func (c grpcPassthroughCreds) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (grpcPassthroughCreds) OverrideServerName(string) error {
+	return nil
+}
+
+// unwrapTLSConn recovers the *tls.Conn a cmux matcher handed back, unwrapping
+// cmux's own net.Conn wrapper (which embeds, rather than is, the original
+// connection) until it finds one.
+func unwrapTLSConn(conn net.Conn) (*tls.Conn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c, true
+		case *cmux.MuxConn:
+			conn = c.Conn
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package headscale
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestAuthenticateGRPCBearerToken(t *testing.T) {
+	store := newMemoryDatastore()
+	h := &Headscale{store: store}
+
+	rawKey, err := CreateAPIKey(store, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("CreateAPIKey() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr bool
+	}{
+		{
+			name:    "valid bearer token",
+			ctx:     metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+rawKey)),
+			wantErr: false,
+		},
+		{
+			name:    "missing metadata",
+			ctx:     context.Background(),
+			wantErr: true,
+		},
+		{
+			name:    "not a bearer token",
+			ctx:     metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", rawKey)),
+			wantErr: true,
+		},
+		{
+			name:    "invalid token",
+			ctx:     metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer bogus.bogus")),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.authenticateGRPCBearerToken(tt.ctx); (err != nil) != tt.wantErr {
+				t.Errorf("authenticateGRPCBearerToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticateGRPCMTLS(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"admin.example.com"}}
+
+	withPeer := func(certs ...*x509.Certificate) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: certs}},
+		})
+	}
+
+	h := &Headscale{cfg: Config{GRPC: GRPCConfig{AdminMTLSSANs: []string{"admin.example.com"}}}}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr bool
+	}{
+		{"allowed SAN", withPeer(cert), false},
+		{"no certificate presented", withPeer(), true},
+		{"no peer information", context.Background(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.authenticateGRPCMTLS(tt.ctx); (err != nil) != tt.wantErr {
+				t.Errorf("authenticateGRPCMTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("mTLS not configured", func(t *testing.T) {
+		h := &Headscale{}
+		if err := h.authenticateGRPCMTLS(withPeer(cert)); err == nil {
+			t.Error("authenticateGRPCMTLS() expected error when AdminMTLSSANs is empty")
+		}
+	})
+}
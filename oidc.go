@@ -0,0 +1,251 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+const defaultOIDCNamespaceClaim = "email"
+
+// oidcClaims is the subset of standard and well-known OIDC claims headscale
+// understands when provisioning namespaces and enforcing access.
+type oidcClaims struct {
+	Email         string         `json:"email"`
+	EmailVerified bool           `json:"email_verified"`
+	Groups        []string       `json:"groups"`
+	Raw           map[string]any `json:"-"`
+}
+
+// initOIDC sets up the OIDC provider, oauth2 config and the short-lived
+// state cache used to protect the authorization code flow.
+func (h *Headscale) initOIDC() error {
+	var err error
+
+	h.oidcProvider, err = oidc.NewProvider(context.Background(), h.cfg.OIDC.Issuer)
+	if err != nil {
+		return fmt.Errorf("creating OIDC provider: %w", err)
+	}
+
+	h.oauth2Config = &oauth2.Config{
+		ClientID:     h.cfg.OIDC.ClientID,
+		ClientSecret: h.cfg.OIDC.ClientSecret,
+		Endpoint:     h.oidcProvider.Endpoint(),
+		RedirectURL:  fmt.Sprintf("%s/oidc/callback", h.cfg.ServerURL),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+	}
+
+	h.oidcStateCache = cache.New(time.Minute*5, time.Minute*10)
+
+	return nil
+}
+
+// OIDCCallback finishes the OIDC authorization code flow: it exchanges the
+// code for tokens, validates the ID token, maps its claims onto a namespace
+// (auto-provisioning it if needed) and enforces OIDC.AllowedGroups.
+func (h *Headscale) OIDCCallback(c *gin.Context) {
+	state := c.Query("state")
+	if state == "" {
+		c.String(http.StatusBadRequest, "missing state parameter")
+
+		return
+	}
+
+	if _, found := h.oidcStateCache.Get(state); !found {
+		c.String(http.StatusBadRequest, "invalid or expired state parameter")
+
+		return
+	}
+	h.oidcStateCache.Delete(state)
+
+	oauth2Token, err := h.oauth2Config.Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to exchange OIDC code for token")
+		c.String(http.StatusBadRequest, "failed to exchange code for token")
+
+		return
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		c.String(http.StatusBadRequest, "id_token missing from OIDC token response")
+
+		return
+	}
+
+	verifier := h.oidcProvider.Verifier(&oidc.Config{ClientID: h.cfg.OIDC.ClientID})
+
+	idToken, err := verifier.Verify(c.Request.Context(), rawIDToken)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to verify OIDC id_token")
+		c.String(http.StatusBadRequest, "failed to verify id_token")
+
+		return
+	}
+
+	var rawClaims map[string]any
+	if err := idToken.Claims(&rawClaims); err != nil {
+		log.Error().Err(err).Msg("Failed to decode OIDC claims")
+		c.String(http.StatusInternalServerError, "failed to decode claims")
+
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		log.Error().Err(err).Msg("Failed to decode OIDC claims")
+		c.String(http.StatusInternalServerError, "failed to decode claims")
+
+		return
+	}
+	claims.Raw = rawClaims
+
+	if len(h.cfg.OIDC.AllowedGroups) > 0 && !groupAllowed(h.cfg.OIDC.AllowedGroups, claims.Groups) {
+		log.Warn().Str("email", claims.Email).Strs("groups", claims.Groups).
+			Msg("OIDC user rejected: not a member of any allowed group")
+		c.String(http.StatusForbidden, "not a member of an allowed group")
+
+		return
+	}
+
+	namespaceName, err := h.namespaceNameFromClaims(claims)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to derive namespace from OIDC claims")
+		c.String(http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	namespace, err := h.findOrCreateNamespace(namespaceName)
+	if err != nil {
+		log.Error().Err(err).Str("namespace", namespaceName).Msg("Failed to provision namespace for OIDC user")
+		c.String(http.StatusInternalServerError, "failed to provision namespace")
+
+		return
+	}
+
+	log.Info().Str("namespace", namespace.Name).Str("email", claims.Email).Msg("OIDC user authenticated")
+
+	c.JSON(http.StatusOK, gin.H{"namespace": namespace.Name})
+}
+
+// namespaceNameFromClaims resolves the namespace a user should land in,
+// following OIDC.NamespaceClaim (defaulting to the email claim) and
+// optionally stripping the email domain per OIDC.StripEmailDomain.
+func (h *Headscale) namespaceNameFromClaims(claims oidcClaims) (string, error) {
+	claimName := h.cfg.OIDC.NamespaceClaim
+	if claimName == "" {
+		claimName = defaultOIDCNamespaceClaim
+	}
+
+	value, err := claimByPath(claims.Raw, claimName)
+	if err != nil {
+		return "", fmt.Errorf("resolving namespace claim %q: %w", claimName, err)
+	}
+
+	name, err := firstClaimValue(value)
+	if err != nil {
+		return "", fmt.Errorf("namespace claim %q: %w", claimName, err)
+	}
+
+	if claimName == defaultOIDCNamespaceClaim {
+		if !claims.EmailVerified {
+			return "", errors.New("cannot provision a namespace from an unverified email")
+		}
+
+		if h.cfg.OIDC.StripEmailDomain {
+			if at := strings.Index(name, "@"); at != -1 {
+				name = name[:at]
+			}
+		}
+	}
+
+	return name, nil
+}
+
+// firstClaimValue normalizes a claim value to the single string headscale
+// derives a namespace name from. Scalar claims (e.g. "email") are used
+// as-is; list claims (e.g. "groups") use their first non-empty string
+// entry, so NamespaceClaim can point at group/role-mapping claims as well
+// as the email claim.
+func firstClaimValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return "", errors.New("resolved to an empty string")
+		}
+
+		return v, nil
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				return s, nil
+			}
+		}
+
+		return "", errors.New("resolved to an empty list, or a list with no string entries")
+	default:
+		return "", errors.New("did not resolve to a string or a list of strings")
+	}
+}
+
+// claimByPath looks up a (possibly nested) claim addressed by a dotted
+// path, e.g. "organization.name". This intentionally supports only plain
+// dotted traversal of the claim set rather than full JSONPath, to avoid
+// pulling in a JSONPath dependency for what is, in practice, always a
+// shallow lookup.
+func claimByPath(claims map[string]any, path string) (any, error) {
+	var cur any = claims
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("claim segment %q is not an object", key)
+		}
+
+		cur, ok = m[key]
+		if !ok {
+			return nil, fmt.Errorf("claim %q not present", key)
+		}
+	}
+
+	return cur, nil
+}
+
+// groupAllowed reports whether any of userGroups appears in allowedGroups.
+func groupAllowed(allowedGroups, userGroups []string) bool {
+	allowed := make(map[string]struct{}, len(allowedGroups))
+	for _, g := range allowedGroups {
+		allowed[g] = struct{}{}
+	}
+
+	for _, g := range userGroups {
+		if _, ok := allowed[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findOrCreateNamespace looks up a namespace by name, creating it if it does
+// not yet exist; no ACL policy is attached to a new namespace. This is how OIDC
+// auto-provisioning avoids requiring operators to pre-create namespaces for
+// every group or email address.
+func (h *Headscale) findOrCreateNamespace(name string) (*Namespace, error) {
+	namespace, err := h.store.GetNamespace(name)
+	if err == nil {
+		return namespace, nil
+	}
+
+	return h.store.CreateNamespace(name)
+}
@@ -0,0 +1,125 @@
+package headscale
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+)
+
+// netMapKeepAliveInterval is how often PollNetMapHandler writes a keepalive
+// frame down an otherwise-idle stream, so proxies and clients don't mistake
+// a quiet tailnet for a dead connection.
+const netMapKeepAliveInterval = 60 * time.Second
+
+var netMapKeepAliveFrame = []byte("\n")
+
+// PollNetMapHandler is the long-lived streaming endpoint tailscale clients
+// open to learn about changes to their tailnet. It blocks on the namespace's
+// event bus (see events.go) instead of re-checking the database on a timer,
+// so peer and ACL changes reach a polling client within the event bus's
+// latency rather than after up to updateMillisecondsWait of staleness.
+func (h *Headscale) PollNetMapHandler(c *gin.Context) {
+	machineID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid machine id")
+
+		return
+	}
+
+	machine, err := h.store.GetMachineByID(machineID)
+	if err != nil {
+		c.String(http.StatusNotFound, "unknown machine")
+
+		return
+	}
+
+	ch, cancel := h.Subscribe(machine.Namespace.Name)
+	defer cancel()
+
+	// Send the client its current netmap right away, so it doesn't have to
+	// wait for the next event before seeing anything.
+	if data, err := h.netMapResponseFor(machine); err == nil {
+		_, _ = c.Writer.Write(data)
+		c.Writer.Flush()
+	}
+
+	keepAliveTicker := time.NewTicker(netMapKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+
+		case _, ok := <-ch:
+			if !ok {
+				return false
+			}
+
+			data, err := h.netMapResponseFor(machine)
+			if err != nil {
+				log.Error().Err(err).Str("machine", machine.Name).Msg("Failed to build netmap response")
+
+				return false
+			}
+
+			_, _ = w.Write(data)
+
+			return true
+
+		case <-keepAliveTicker.C:
+			_, _ = w.Write(netMapKeepAliveFrame)
+
+			return true
+		}
+	})
+}
+
+// netMapResponseFor renders machine's current view of its namespace as the
+// JSON-encoded tailcfg.MapResponse a polling client expects, carrying the
+// namespace's peers, DERP map, DNS config and packet filter.
+func (h *Headscale) netMapResponseFor(machine *Machine) ([]byte, error) {
+	machines, err := h.store.ListMachinesInNamespace(machine.Namespace.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]*tailcfg.Node, 0, len(*machines))
+	for _, peer := range *machines {
+		peers = append(peers, machineToNode(peer))
+	}
+
+	resp := &tailcfg.MapResponse{
+		Node:    machineToNode(*machine),
+		Peers:   peers,
+		DERPMap: h.DERPMap,
+	}
+
+	if h.cfg.DNSConfig != nil {
+		resp.DNSConfig = *h.cfg.DNSConfig
+	}
+
+	if h.aclRules != nil {
+		resp.PacketFilter = *h.aclRules
+	}
+
+	return json.Marshal(resp)
+}
+
+// machineToNode converts a Machine to the tailcfg.Node shape a MapResponse
+// carries. Key, address and endpoint assignment belong to the registration
+// path elsewhere in the codebase; this only fills in what a netmap poll
+// response needs to identify peers by name, and deliberately leaves out
+// machine.AuthKey, which must never reach a polling client.
+func machineToNode(machine Machine) *tailcfg.Node {
+	return &tailcfg.Node{
+		ID:   tailcfg.NodeID(machine.ID),
+		Name: machine.Name,
+	}
+}
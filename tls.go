@@ -0,0 +1,266 @@
+package headscale
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig selects and configures how headscale serves TLS certificates.
+type TLSConfig struct {
+	// Provider selects the CertProvider implementation to use. One of
+	// "acme" (Let's Encrypt or any other ACME CA), "file" (a static
+	// cert/key pair, optionally hot-reloaded from disk), "spiffe" (a
+	// short-lived cert fetched by running an external command), or ""
+	// (auto-detect: "acme" if TLSLetsEncryptHostname is set, else "file"
+	// if TLSCertPath is set, else plain HTTP).
+	Provider string
+
+	// FileWatch, when true, makes the "file" provider reload
+	// TLSCertPath/TLSKeyPath whenever they change on disk instead of
+	// only at startup.
+	FileWatch bool
+
+	// SpiffeFetchCommand is executed to obtain a fresh certificate and
+	// key. It must print a PEM-encoded certificate followed by a
+	// PEM-encoded key to stdout. Used by the "spiffe" provider.
+	SpiffeFetchCommand string
+
+	// SpiffeFetchInterval controls how often SpiffeFetchCommand is
+	// re-run to rotate the certificate. Defaults to five minutes if
+	// unset.
+	SpiffeFetchInterval time.Duration
+}
+
+// CertProvider produces the *tls.Config headscale should serve with. Some
+// providers return a static config, others keep rotating certificates
+// in the background and always answer with the current one via
+// tls.Config.GetCertificate.
+type CertProvider interface {
+	// TLSConfig returns the tls.Config to install on the HTTP server. It
+	// may be called once at startup.
+	TLSConfig() (*tls.Config, error)
+
+	// Close stops any background rotation goroutines started by the
+	// provider.
+	Close() error
+}
+
+// getTLSSettings builds the CertProvider configured by h.cfg and returns the
+// *tls.Config it produces, or nil if headscale should serve plain HTTP.
+func (h *Headscale) getTLSSettings() (*tls.Config, error) {
+	provider, err := h.newCertProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	if provider == nil {
+		if !strings.HasPrefix(h.cfg.ServerURL, "http://") {
+			log.Warn().Msg("Listening without TLS but ServerURL does not start with http://")
+		}
+
+		return nil, nil
+	}
+
+	h.certProvider = provider
+
+	return provider.TLSConfig()
+}
+
+// newCertProvider picks a CertProvider based on h.cfg.TLS.Provider, falling
+// back to the pre-existing auto-detection (LetsEncrypt hostname set, then
+// TLSCertPath set, then none) so existing configs keep working unchanged.
+func (h *Headscale) newCertProvider() (CertProvider, error) {
+	provider := h.cfg.TLS.Provider
+	if provider == "" {
+		switch {
+		case h.cfg.TLSLetsEncryptHostname != "":
+			provider = "acme"
+		case h.cfg.TLSCertPath != "":
+			provider = "file"
+		default:
+			return nil, nil
+		}
+	}
+
+	switch provider {
+	case "acme":
+		return newACMECertProvider(h)
+	case "file":
+		return newFileCertProvider(h.cfg.TLSCertPath, h.cfg.TLSKeyPath, h.cfg.TLS.FileWatch)
+	case "spiffe":
+		return newSpiffeCertProvider(h.cfg.TLS.SpiffeFetchCommand, h.cfg.TLS.SpiffeFetchInterval)
+	default:
+		return nil, fmt.Errorf("unknown TLS.Provider %q", provider)
+	}
+}
+
+// acmeCertProvider serves certificates obtained from an ACME CA, e.g. Let's
+// Encrypt, using golang.org/x/crypto/acme/autocert.
+type acmeCertProvider struct {
+	manager *autocert.Manager
+}
+
+func newACMECertProvider(h *Headscale) (CertProvider, error) {
+	if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
+		log.Warn().Msg("Listening with TLS but ServerURL does not start with https://")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(h.cfg.TLSLetsEncryptHostname),
+		Cache:      autocert.DirCache(h.cfg.TLSLetsEncryptCacheDir),
+		Client: &acme.Client{
+			DirectoryURL: h.cfg.ACMEURL,
+		},
+		Email: h.cfg.ACMEEmail,
+	}
+
+	switch h.cfg.TLSLetsEncryptChallengeType {
+	case "TLS-ALPN-01":
+		// Configuration via autocert with TLS-ALPN-01 (https://tools.ietf.org/html/rfc8737)
+		// The RFC requires that the validation is done on port 443; in other words, headscale
+		// must be reachable on port 443.
+	case "HTTP-01":
+		// Configuration via autocert with HTTP-01. This requires listening on
+		// port 80 for the certificate validation in addition to the headscale
+		// service, which can be configured to run on any other port.
+		go func() {
+			log.Fatal().
+				Err(http.ListenAndServe(h.cfg.TLSLetsEncryptListen, m.HTTPHandler(http.HandlerFunc(h.redirect)))).
+				Msg("failed to set up a HTTP server")
+		}()
+	default:
+		return nil, errors.New("unknown value for TLSLetsEncryptChallengeType")
+	}
+
+	return &acmeCertProvider{manager: m}, nil
+}
+
+func (p *acmeCertProvider) TLSConfig() (*tls.Config, error) {
+	return p.manager.TLSConfig(), nil
+}
+
+func (p *acmeCertProvider) Close() error {
+	return nil
+}
+
+// fileCertProvider serves a static certificate/key pair from disk, with
+// optional hot reload when the files change on disk.
+type fileCertProvider struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func newFileCertProvider(certPath, keyPath string, watch bool) (CertProvider, error) {
+	p := &fileCertProvider{certPath: certPath, keyPath: keyPath}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	if !watch {
+		return p, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("setting up TLS file watcher: %w", err)
+	}
+
+	if err := watcher.Add(certPath); err != nil {
+		watcher.Close()
+
+		return nil, fmt.Errorf("watching %s: %w", certPath, err)
+	}
+
+	if err := watcher.Add(keyPath); err != nil {
+		watcher.Close()
+
+		return nil, fmt.Errorf("watching %s: %w", keyPath, err)
+	}
+
+	p.watcher = watcher
+	p.done = make(chan struct{})
+
+	go p.watch()
+
+	return p, nil
+}
+
+func (p *fileCertProvider) reload() error {
+	cert, err := tls.LoadX509KeyPair(p.certPath, p.keyPath)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.cert = &cert
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *fileCertProvider) watch() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case event, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			log.Info().Str("file", event.Name).Msg("TLS certificate file changed, reloading")
+
+			if err := p.reload(); err != nil {
+				log.Error().Err(err).Msg("failed to reload TLS certificate, keeping previous one in use")
+			}
+		case err, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("TLS file watcher error")
+		}
+	}
+}
+
+func (p *fileCertProvider) TLSConfig() (*tls.Config, error) {
+	return &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			p.mu.RLock()
+			defer p.mu.RUnlock()
+
+			return p.cert, nil
+		},
+	}, nil
+}
+
+func (p *fileCertProvider) Close() error {
+	if p.watcher == nil {
+		return nil
+	}
+
+	close(p.done)
+
+	return p.watcher.Close()
+}